@@ -0,0 +1,287 @@
+// Package imagelist is a small HTTP client for the imagelist service's
+// image lifecycle API: creating or replacing a record, patching its tag
+// list, and deleting it.
+package imagelist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	imagesPath = "/images"
+
+	// initialRetryBackoff and maxRetryBackoff bound the exponential
+	// backoff used between submission retries.
+	initialRetryBackoff = time.Second
+	maxRetryBackoff     = 30 * time.Second
+)
+
+var logger = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
+
+// Image is an imagelist image record: a content digest, its canonical
+// repository name, and the tags currently pointing at it.
+type Image struct {
+	ID   string   `json:"id"`
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// PatchImage describes a partial update to an image record already known
+// to imagelist. Only Tags is supported today: it replaces the tag list
+// imagelist has on file for the image.
+type PatchImage struct {
+	Tags []string `json:"tags"`
+}
+
+// Client submits image lifecycle events to an imagelist deployment.
+type Client struct {
+	URL              string
+	Token            string
+	HTTPClient       *http.Client
+	MaxRetryDuration time.Duration
+
+	// DryRun, when true, logs the request that would have been sent
+	// instead of sending it.
+	DryRun bool
+
+	// OnRetry and OnResult, when set, are called as a submission is
+	// retried and as it finally succeeds or fails, so callers can
+	// instrument submissions without this package depending on a
+	// metrics library.
+	OnRetry  func()
+	OnResult func(result string, duration time.Duration)
+}
+
+// Put creates or replaces i's record in imagelist.
+func (c *Client) Put(i Image) error {
+	u, err := joinURL(c.URL, imagesPath)
+	if err != nil {
+		return fmt.Errorf("failed to build imagelist url: %v", err)
+	}
+
+	return c.submit(http.MethodPut, u, i)
+}
+
+// Patch updates the tag list imagelist has on file for the image
+// identified by digest.
+func (c *Client) Patch(digest string, patch PatchImage) error {
+	u, err := joinURL(c.URL, path.Join(imagesPath, digest))
+	if err != nil {
+		return fmt.Errorf("failed to build imagelist url: %v", err)
+	}
+
+	return c.submit(http.MethodPatch, u, patch)
+}
+
+// Delete removes the image identified by digest from imagelist.
+func (c *Client) Delete(digest string) error {
+	u, err := joinURL(c.URL, path.Join(imagesPath, digest))
+	if err != nil {
+		return fmt.Errorf("failed to build imagelist url: %v", err)
+	}
+
+	return c.submit(http.MethodDelete, u, nil)
+}
+
+func (c *Client) submit(method, u string, body interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s %s: %v", method, u, err)
+		}
+	}
+
+	if c.DryRun {
+		logger.Printf("dry-run: %s %s %s", method, u, data)
+		return nil
+	}
+
+	start := time.Now()
+	err := c.do(method, u, data)
+	if c.OnResult != nil {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		c.OnResult(result, time.Since(start))
+	}
+
+	return err
+}
+
+// do PUTs/PATCHes/DELETEs u, backing off exponentially between attempts
+// until MaxRetryDuration elapses. 401/403 are treated as retryable: some
+// auth backends issue tokens valid only from "now", so a first 401 caused
+// by clock skew gets one immediate retry before the backoff kicks in. A
+// 429/503 response honors any Retry-After the server sends.
+func (c *Client) do(method, u string, data []byte) error {
+	start := time.Now()
+	backoff := time.Duration(0)
+	unauthorizedRetried := false
+	attempted := false
+
+	for {
+		if c.MaxRetryDuration > 0 && time.Since(start) > c.MaxRetryDuration {
+			return fmt.Errorf("max retry duration exceeded submitting %s %s", method, u)
+		}
+
+		if backoff > 0 {
+			<-time.After(backoff)
+		}
+		if attempted && c.OnRetry != nil {
+			c.OnRetry()
+		}
+		attempted = true
+
+		var body io.Reader
+		if data != nil {
+			body = bytes.NewReader(data)
+		}
+
+		resp, err := c.httpDo(method, u, body)
+		if err != nil {
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+			drainAndClose(resp)
+			return nil
+
+		case http.StatusNotFound:
+			drainAndClose(resp)
+			if method == http.MethodDelete {
+				// Already gone: nothing left to reconcile.
+				return nil
+			}
+			return fmt.Errorf("%s %s: not found", method, u)
+
+		case http.StatusUnauthorized, http.StatusForbidden:
+			drainAndClose(resp)
+			if !unauthorizedRetried {
+				unauthorizedRetried = true
+				backoff = 0
+				continue
+			}
+			backoff = nextBackoff(backoff)
+			continue
+
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			wait := retryAfter(resp.Header.Get("Retry-After"))
+			drainAndClose(resp)
+			if wait > 0 {
+				backoff = wait
+			} else {
+				backoff = nextBackoff(backoff)
+			}
+			continue
+
+		case http.StatusInternalServerError:
+			drainAndClose(resp)
+			backoff = nextBackoff(backoff)
+			continue
+
+		default:
+			drainAndClose(resp)
+			return fmt.Errorf("%s %s: unexpected status %d", method, u, resp.StatusCode)
+		}
+	}
+}
+
+func (c *Client) httpDo(method, u string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	return c.HTTPClient.Do(req)
+}
+
+// nextBackoff doubles current, starting at initialRetryBackoff, capping at
+// maxRetryBackoff, and adding up to 50% jitter to avoid thundering-herd
+// retries against imagelist.
+func nextBackoff(current time.Duration) time.Duration {
+	next := current * 2
+	if next <= 0 {
+		next = initialRetryBackoff
+	}
+	if next > maxRetryBackoff {
+		next = maxRetryBackoff
+	}
+
+	return next + time.Duration(rand.Int63n(int64(next)/2+1))
+}
+
+// retryAfter parses a Retry-After header, which may be either a number of
+// seconds or an HTTP date, returning 0 if it is absent or unparseable.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+func drainAndClose(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// NewHTTPClient builds the http.Client used to talk to imagelist,
+// configuring mTLS and/or a custom CA when the corresponding paths are
+// set.
+func NewHTTPClient(caFile, certFile, keyFile string) (*http.Client, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig, err := tlsConfigFor(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+func joinURL(u, p string) (string, error) {
+	ref, err := url.Parse(p)
+	if err != nil {
+		return "", err
+	}
+	base, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
@@ -0,0 +1,191 @@
+package imagelist
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeJSON(t *testing.T, r *http.Request, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		t.Fatalf("failed to decode request body: %v", err)
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	backoff := time.Duration(0)
+	for i := 0; i < 10; i++ {
+		next := nextBackoff(backoff)
+		if next < initialRetryBackoff {
+			t.Fatalf("nextBackoff(%s) = %s, want at least %s", backoff, next, initialRetryBackoff)
+		}
+		if next > maxRetryBackoff+maxRetryBackoff/2 {
+			t.Fatalf("nextBackoff(%s) = %s, want at most %s", backoff, next, maxRetryBackoff+maxRetryBackoff/2)
+		}
+		backoff = next
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"120", 120 * time.Second},
+		{"not-a-number-or-date", 0},
+	}
+
+	for _, c := range cases {
+		got := retryAfter(c.header)
+		assert.Equal(t, c.want, got, "retryAfter(%q)", c.header)
+	}
+}
+
+func TestClientPut(t *testing.T) {
+	var gotMethod, gotPath string
+	var gotBody Image
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		decodeJSON(t, r, &gotBody)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, HTTPClient: srv.Client()}
+	img := Image{ID: "sha256:deadbeef", Name: "docker.io/library/did", Tags: []string{"latest"}}
+
+	if err := c.Put(img); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+
+	assert.Equal(t, http.MethodPut, gotMethod)
+	assert.Equal(t, "/images", gotPath)
+	assert.Equal(t, img, gotBody)
+}
+
+func TestClientPatch(t *testing.T) {
+	var gotMethod, gotPath string
+	var gotBody PatchImage
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		decodeJSON(t, r, &gotBody)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, HTTPClient: srv.Client()}
+	if err := c.Patch("sha256:deadbeef", PatchImage{Tags: []string{"v2"}}); err != nil {
+		t.Fatalf("Patch: unexpected error: %v", err)
+	}
+
+	assert.Equal(t, http.MethodPatch, gotMethod)
+	assert.Equal(t, "/images/sha256:deadbeef", gotPath)
+	assert.Equal(t, PatchImage{Tags: []string{"v2"}}, gotBody)
+}
+
+func TestClientDeleteNotFoundIsNotAnError(t *testing.T) {
+	var gotMethod, gotPath string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, HTTPClient: srv.Client()}
+	if err := c.Delete("sha256:deadbeef"); err != nil {
+		t.Fatalf("Delete: expected a 404 to be treated as already-deleted, got: %v", err)
+	}
+
+	assert.Equal(t, http.MethodDelete, gotMethod)
+	assert.Equal(t, "/images/sha256:deadbeef", gotPath)
+}
+
+func TestClientRetriesOnceOnUnauthorized(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, HTTPClient: srv.Client()}
+
+	start := time.Now()
+	if err := c.Put(Image{ID: "sha256:deadbeef", Name: "did", Tags: []string{"latest"}}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	assert.Equal(t, 2, requests, "a 401 must be retried exactly once")
+	assert.Less(t, elapsed, initialRetryBackoff, "the first 401 retry must not wait out the backoff")
+}
+
+func TestClientHonorsRetryAfter(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, HTTPClient: srv.Client()}
+
+	start := time.Now()
+	if err := c.Put(Image{ID: "sha256:deadbeef", Name: "did", Tags: []string{"latest"}}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	assert.Equal(t, 2, requests)
+	assert.GreaterOrEqual(t, elapsed, time.Second, "a 429 with Retry-After: 1 must wait at least a second before retrying")
+}
+
+func TestClientGivesUpAfterMaxRetryDuration(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, HTTPClient: srv.Client(), MaxRetryDuration: 50 * time.Millisecond}
+
+	err := c.Put(Image{ID: "sha256:deadbeef", Name: "did", Tags: []string{"latest"}})
+	if err == nil {
+		t.Fatal("Put: expected an error once MaxRetryDuration elapsed, got none")
+	}
+}
+
+func TestClientDryRunDoesNotCallServer(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, HTTPClient: srv.Client(), DryRun: true}
+	if err := c.Put(Image{ID: "sha256:deadbeef", Name: "did", Tags: []string{"latest"}}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+
+	assert.False(t, called, "dry-run must not contact the imagelist service")
+}
@@ -1,36 +1,38 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
-	"regexp"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/urfave/cli"
-)
 
-const (
-	imageListPutImagesPath = "/images"
+	"github.com/UKHomeOffice/imagelist-docker-events/imagelist"
 )
 
 var (
-	tagRegexp = regexp.MustCompile(`:([\w][\w.-]{0,127})$`)
-	logger    = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
+	logger = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
 )
 
+// eventHandlers maps a docker image event action to the function that
+// reconciles it against imagelist. Actions with no entry are ignored.
+var eventHandlers = map[string]func(events.Message, *imagelist.Client){
+	"push":   handlePush,
+	"tag":    handleTag,
+	"untag":  handleUntag,
+	"delete": handleDelete,
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "imagelist-docker-events"
@@ -42,6 +44,49 @@ func main() {
 			Name:  "imagelist-url",
 			Usage: "imagelist service url",
 		},
+		cli.StringFlag{
+			Name:  "registry-url",
+			Usage: "registry v2 API url, e.g. https://registry.example.com; enables periodic catalog reconciliation against imagelist",
+		},
+		cli.DurationFlag{
+			Name:  "reconcile-interval",
+			Usage: "how often to walk the registry catalog when --registry-url is set",
+			Value: 5 * time.Minute,
+		},
+		cli.StringFlag{
+			Name:  "reconcile-cursor-file",
+			Usage: "file used to remember the last reconciled repository across restarts",
+			Value: "/var/lib/imagelist-docker-events/reconcile-cursor.json",
+		},
+		cli.StringFlag{
+			Name:  "imagelist-token",
+			Usage: "bearer token used to authenticate to imagelist",
+		},
+		cli.StringFlag{
+			Name:  "imagelist-ca",
+			Usage: "path to a CA bundle used to verify the imagelist service",
+		},
+		cli.StringFlag{
+			Name:  "imagelist-cert",
+			Usage: "path to a client certificate used for mTLS to imagelist, requires --imagelist-key",
+		},
+		cli.StringFlag{
+			Name:  "imagelist-key",
+			Usage: "path to the private key matching --imagelist-cert",
+		},
+		cli.DurationFlag{
+			Name:  "max-retry-duration",
+			Usage: "how long to keep retrying a failed imagelist submission before giving up",
+			Value: 5 * time.Minute,
+		},
+		cli.StringFlag{
+			Name:  "metrics-addr",
+			Usage: "address to serve Prometheus metrics and /healthz, /readyz on, e.g. :8080 (disabled if unset)",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "log imagelist submissions instead of sending them",
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
@@ -51,23 +96,52 @@ func main() {
 		if !c.IsSet("imagelist-url") {
 			return cli.NewExitError("error: imagelist-url needs to be set", 1)
 		}
-		u := c.String("imagelist-url")
-		imageListURL, err := joinURL(u, imageListPutImagesPath)
+
+		httpClient, err := imagelist.NewHTTPClient(c.String("imagelist-ca"), c.String("imagelist-cert"), c.String("imagelist-key"))
 		if err != nil {
-			return cli.NewExitError(fmt.Sprintf("error: failed to parse imagelist url: %v", err), 1)
+			return cli.NewExitError(fmt.Sprintf("error: %v", err), 1)
+		}
+
+		cl := &imagelist.Client{
+			URL:              c.String("imagelist-url"),
+			Token:            c.String("imagelist-token"),
+			HTTPClient:       httpClient,
+			MaxRetryDuration: c.Duration("max-retry-duration"),
+			DryRun:           c.Bool("dry-run"),
+			OnRetry:          func() { submissionRetriesTotal.Inc() },
+			OnResult:         recordSubmissionResult,
+		}
+
+		if c.IsSet("registry-url") {
+			reconciler := newRegistryReconciler(c.String("registry-url"), cl, c.String("reconcile-cursor-file"))
+			go reconciler.run(context.Background(), c.Duration("reconcile-interval"))
+		}
+
+		if c.IsSet("metrics-addr") {
+			go startMetricsServer(c.String("metrics-addr"))
 		}
 
 		// main loop
+		reconnecting := false
 		for {
 			c, err := client.NewEnvClient()
 			if err != nil {
 				logger.Printf("error: docker connection failed: %v", err)
+				agentHealth.setDockerConnected(false, err)
+				<-time.After(time.Second)
+				continue
+			}
+			if reconnecting {
+				dockerReconnectsTotal.Inc()
 			}
+			reconnecting = true
+			agentHealth.setDockerConnected(true, nil)
 			defer c.Close()
 
 			messages, errs := c.Events(context.Background(), types.EventsOptions{Filters: f})
-			if err := processEvents(messages, errs, imageListURL); err != nil {
+			if err := processEvents(messages, errs, cl); err != nil {
 				logger.Print(err)
+				agentHealth.setDockerConnected(false, err)
 				<-time.After(time.Second)
 				continue
 			}
@@ -78,82 +152,239 @@ func main() {
 	app.Run(os.Args)
 }
 
-func processEvents(messages <-chan events.Message, errs <-chan error, url string) error {
+func processEvents(messages <-chan events.Message, errs <-chan error, cl *imagelist.Client) error {
 	select {
 	case err := <-errs:
 		if err != nil && err != io.EOF {
 			return fmt.Errorf("error: failed to read events: %v", err)
 		}
 	case m := <-messages:
-		if m.Type == "image" && m.Action == "push" {
-			go addToImageList(m.ID, url)
+		if m.Type == "image" {
+			eventsReceivedTotal.WithLabelValues(m.Action).Inc()
+			if handler, ok := eventHandlers[m.Action]; ok {
+				go handler(m, cl)
+			}
 		}
 	}
 	return nil
 }
 
-type image struct {
-	ID   string   `json:"id"`
-	Name string   `json:"name"`
-	Tags []string `json:"tags"`
+// recordSubmissionResult is an imagelist.Client.OnResult callback that
+// feeds the submission_duration_seconds histogram, the submissions_total
+// counter and the health check's last-successful-submission timestamp.
+func recordSubmissionResult(result string, duration time.Duration) {
+	submissionDurationSeconds.Observe(duration.Seconds())
+	submissionsTotal.WithLabelValues(result).Inc()
+	if result == "success" {
+		agentHealth.recordSubmission(time.Now())
+	}
+}
+
+// handlePush reconciles a "push" event. Docker sets m.ID to the pushed
+// reference itself (reference.FamiliarString, e.g. "name:tag" or
+// "name@digest") for push, unlike tag/untag/delete below, so it doubles
+// as both the docker inspect target and the name used to match
+// RepoDigests/RepoTags.
+func handlePush(m events.Message, cl *imagelist.Client) {
+	submitReconciled(m.ID, m.ID, cl)
+}
+
+// handleTag reconciles a "tag" event. Docker sets m.ID to the image's
+// local content ID for tag events (it is only a name reference for
+// push), so the tag actually being added comes from the event's "name"
+// actor attribute (reference.FamiliarString(newTag)) instead; m.ID
+// remains a valid docker inspect target.
+func handleTag(m events.Message, cl *imagelist.Client) {
+	name := m.Actor.Attributes["name"]
+	if name == "" {
+		logger.Printf("error: tag event for %q has no name attribute", m.ID)
+		return
+	}
+
+	submitReconciled(m.ID, name, cl)
+}
+
+// handleUntag reconciles an "untag" event: the image itself still
+// exists, it has simply lost one of its names. Docker's untag event
+// carries no usable name (its "name" attribute is just the image ID
+// again), so the repositories to re-check come from every repo name
+// submitted has ever recorded a PUT/PATCH under for this image ID - an
+// image can be tagged into more than one repository, and each gets its
+// own "tag" event sharing the same image ID, so all of them must be
+// kept, not just the most recent.
+func handleUntag(m events.Message, cl *imagelist.Client) {
+	names := submitted.names(m.ID)
+	if len(names) == 0 {
+		logger.Printf("error: untag event for %q has no previously submitted record to reconcile", m.ID)
+		return
+	}
+
+	for _, name := range names {
+		images, err := submitReconciledTags(m.ID, name)
+		if err != nil {
+			logger.Print(err)
+			continue
+		}
+
+		for _, i := range images {
+			digest, err := digestOf(i.ID)
+			if err != nil {
+				logger.Print(err)
+				continue
+			}
+
+			i := i
+			go submitWithMetrics(i.Name, func() error { return cl.Patch(digest, imagelist.PatchImage{Tags: i.Tags}) })
+		}
+	}
 }
 
-func addToImageList(name string, url string) {
-	images, err := getRepoDigests(name)
+// handleDelete reconciles a "delete" event. Docker's delete event also
+// only carries the image's local content ID, not the repo-scoped
+// manifest digests imagelist keys records by, so the records to remove
+// come from submitted's record of what was last PUT/PATCHed for this
+// image ID.
+func handleDelete(m events.Message, cl *imagelist.Client) {
+	images := submitted.forget(m.ID)
+	if len(images) == 0 {
+		logger.Printf("error: delete event for %q has no previously submitted record to remove", m.ID)
+		return
+	}
+
+	for _, i := range images {
+		digest, err := digestOf(i.ID)
+		if err != nil {
+			logger.Print(err)
+			continue
+		}
+
+		i := i
+		go submitWithMetrics(i.Name, func() error { return cl.Delete(digest) })
+	}
+}
+
+// digestOf extracts the bare content digest (e.g. "sha256:...") from a
+// compound "name@sha256:..." image ID. imagelist.Image.ID carries the
+// compound form - it's what Put's record body identifies the image by -
+// but imagelist's PATCH/DELETE routes address a record by digest alone,
+// so Patch and Delete must be called with just this part.
+func digestOf(id string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(id)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse image id %q: %v", id, err)
+	}
+
+	canonical, ok := named.(reference.Canonical)
+	if !ok {
+		return "", fmt.Errorf("image id %q is not a digest reference", id)
+	}
+
+	return canonical.Digest().String(), nil
+}
+
+// submitWithMetrics runs submit, tracking it in the inflight_submissions
+// gauge and logging any failure.
+func submitWithMetrics(name string, submit func() error) {
+	inflightSubmissions.Inc()
+	defer inflightSubmissions.Dec()
+
+	if err := submit(); err != nil {
+		logger.Printf("error submitting %q image: %v", name, err)
+	}
+}
+
+// submitReconciled inspects inspectRef, PUTs the resulting images to
+// imagelist and records them under inspectRef's local image ID and their
+// repository name so a later untag/delete event for that ID can find
+// them again.
+func submitReconciled(inspectRef, matchName string, cl *imagelist.Client) {
+	images, err := inspectRepoDigests(inspectRef, matchName)
 	if err != nil {
 		logger.Print(err)
 		return
 	}
 
+	submitted.record(inspectRef, images[0].Name, images)
 	for _, i := range images {
-		go func(i image) {
-			attempt := 0
-			for {
-				if attempt == 30 {
-					logger.Printf("error submitting %s image: max retries reached", name)
-					return
-				}
-
-				if attempt != 0 {
-					<-time.After(time.Second * 3)
-				}
-				attempt++
-
-				data, err := json.Marshal(i)
-				if err != nil {
-					logger.Printf("error submitting %q image: %v", i.Name, err)
-					return
-				}
-
-				resp, err := httpPut(url, "application/json", bytes.NewReader(data))
-				if err != nil {
-					logger.Printf("error submitting %q image: %v", i.Name, err)
-					continue
-				}
-				defer func() {
-					io.Copy(ioutil.Discard, resp.Body)
-					resp.Body.Close()
-				}()
-
-				if resp.StatusCode == http.StatusOK {
-					logger.Printf("submitted %+v", i)
-					return
-				}
-
-				if resp.StatusCode == http.StatusInternalServerError {
-					logger.Printf("error submitting %q image: got http status code %d from imagelist", name, resp.StatusCode)
-					continue
-				} else {
-					logger.Printf("error submitting %q image: bad request, status %d from imagelist", name, resp.StatusCode)
-					return
-				}
-			}
-		}(i)
+		i := i
+		go submitWithMetrics(i.Name, func() error { return cl.Put(i) })
+	}
+}
+
+// submitReconciledTags re-inspects inspectRef for matchName's repository
+// and re-records the result under inspectRef's local image ID and
+// repository name, returning the up to date images so the caller can
+// PATCH their tag lists.
+func submitReconciledTags(inspectRef, matchName string) ([]imagelist.Image, error) {
+	images, err := inspectRepoDigests(inspectRef, matchName)
+	if err != nil {
+		return nil, err
 	}
+
+	submitted.record(inspectRef, images[0].Name, images)
+	return images, nil
+}
+
+// submittedTracker remembers, for each docker image ID, the imagelist
+// records most recently submitted per repository name. untag and delete
+// events only carry the image's local content ID, not the repo-scoped
+// name or manifest digest imagelist keys records by, so there is no way
+// to reconcile them correctly without this. Tracking per repository name
+// rather than overwriting a single slot matters because the same image
+// content can be tagged into more than one repository: each gets its own
+// "tag" event sharing the image's content ID, and a later untag of one
+// must not lose track of the others.
+type submittedTracker struct {
+	mu      sync.Mutex
+	records map[string]map[string][]imagelist.Image // imageID -> repo name -> images
+}
+
+var submitted = &submittedTracker{records: make(map[string]map[string][]imagelist.Image)}
+
+func (t *submittedTracker) record(imageID, repoName string, images []imagelist.Image) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.records[imageID] == nil {
+		t.records[imageID] = make(map[string][]imagelist.Image)
+	}
+	t.records[imageID][repoName] = images
 }
 
-func getRepoDigests(name string) ([]image, error) {
-	var images []image
+// names returns every repository name recorded for imageID.
+func (t *submittedTracker) names(imageID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	byName := t.records[imageID]
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	return names
+}
+
+// forget removes and returns every image recorded for imageID, across
+// all of its repository names.
+func (t *submittedTracker) forget(imageID string) []imagelist.Image {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var images []imagelist.Image
+	for _, forName := range t.records[imageID] {
+		images = append(images, forName...)
+	}
+	delete(t.records, imageID)
+
+	return images
+}
+
+// inspectRepoDigests inspects inspectRef with the docker daemon and
+// returns one imagelist.Image per repo digest docker has recorded for the
+// repository matchName belongs to. inspectRef and matchName differ for
+// "tag"/"untag" events, where m.ID is the image's local content ID
+// rather than a name reference.
+func inspectRepoDigests(inspectRef, matchName string) ([]imagelist.Image, error) {
+	var images []imagelist.Image
 
 	// Could use a global client, but docker client does not implement
 	// auto-reconnect and I don't want to implement this myself.
@@ -163,69 +394,64 @@ func getRepoDigests(name string) ([]image, error) {
 	}
 	defer c.Close()
 
-	if !tagRegexp.MatchString(name) {
-		return images, fmt.Errorf("unable to find image %q without a tag", name)
+	named, err := reference.ParseNormalizedNamed(matchName)
+	if err != nil {
+		return images, fmt.Errorf("unable to parse image reference %q: %v", matchName, err)
 	}
+	named = reference.TagNameOnly(named)
 
 	ctx := context.Background()
-	imageInspect, _, err := c.ImageInspectWithRaw(ctx, name)
+	imageInspect, _, err := c.ImageInspectWithRaw(ctx, inspectRef)
 	if err != nil {
 		return images, err
 	}
 
-	dm := mapRepoDigestsToTags(name, imageInspect)
+	dm := mapRepoDigestsToTags(named, imageInspect)
 	if len(dm) == 0 {
-		return images, fmt.Errorf("unable to find repo digests for %q image", name)
+		return images, fmt.Errorf("unable to find repo digests for %q image", matchName)
 	}
 
-	for k, v := range mapRepoDigestsToTags(name, imageInspect) {
-		images = append(images, image{k, tagRegexp.ReplaceAllString(name, ""), v})
+	for k, v := range dm {
+		images = append(images, imagelist.Image{ID: k, Name: named.Name(), Tags: v})
 	}
 
 	return images, nil
 }
 
-// mapRepoDigestsToTags finds RepoDigests that match image name and returns a
-// map of repoDigest to tags.
-func mapRepoDigestsToTags(name string, image types.ImageInspect) map[string][]string {
+// mapRepoDigestsToTags finds RepoDigests that belong to the same
+// repository as named and returns a map of repoDigest to tags. Matching is
+// done on the normalized domain/path of each entry rather than a string
+// prefix, so "foo/bar" no longer matches "foo/bar-baz".
+func mapRepoDigestsToTags(named reference.Named, image types.ImageInspect) map[string][]string {
 	m := make(map[string][]string)
-	if name == "" {
+	if named == nil {
 		return m
 	}
 
-	// trim a tag from image name if exists
-	name = tagRegexp.ReplaceAllString(name, "")
+	domain, path := reference.Domain(named), reference.Path(named)
 
 	tags := []string{}
 	for _, entry := range image.RepoTags {
-		if strings.HasPrefix(entry, name) {
-			matches := tagRegexp.FindStringSubmatch(entry)
-			if len(matches) == 2 {
-				tags = append(tags, matches[1])
-			}
+		t, err := reference.ParseNormalizedNamed(entry)
+		if err != nil || reference.Domain(t) != domain || reference.Path(t) != path {
+			continue
+		}
+		if tagged, ok := t.(reference.NamedTagged); ok {
+			tags = append(tags, tagged.Tag())
 		}
 	}
 
 	for _, entry := range image.RepoDigests {
-		if strings.HasPrefix(entry, name) {
-			m[entry] = tags
+		d, err := reference.ParseNormalizedNamed(entry)
+		if err != nil || reference.Domain(d) != domain || reference.Path(d) != path {
+			continue
 		}
+		m[entry] = tags
 	}
 
 	return m
 }
 
-func httpPut(url string, contentType string, body io.Reader) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodPut, url, body)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", contentType)
-	c := &http.Client{}
-	return c.Do(req)
-}
-
 func joinURL(u, path string) (string, error) {
 	p, err := url.Parse(path)
 	if err != nil {
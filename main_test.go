@@ -1,10 +1,15 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/UKHomeOffice/imagelist-docker-events/imagelist"
 )
 
 func TestMapRepoDigestsToTags(t *testing.T) {
@@ -14,9 +19,12 @@ func TestMapRepoDigestsToTags(t *testing.T) {
 			"quay.io/vaijab/did@sha256:42c5ace3ac1e133a49d81086993e5817e70c67cdbf808bf8934aac78e3e416f0",
 			"quay.io/vaijab/did@sha256:4a967d63c7d5a2da1fd23d5c6733940b2bd8cb1997575d148d5863fd4f460844",
 			"quay.io/vaijab/did@sha256:4e2aa0bc2292b0366dbcde7685c26ce81cfda708bab16d32316704da5d9424ee",
+			"foo/bar@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			"foo/bar-baz@sha256:2222222222222222222222222222222222222222222222222222222222222222",
 		},
 		RepoTags: []string{
-			"foo/bar:notpushedyet",
+			"foo/bar:v1",
+			"foo/bar-baz:v1",
 			"vaijab/did:v1",
 			"quay.io/vaijab/did:v1",
 			"quay.io/vaijab/did:v1.1",
@@ -41,14 +49,31 @@ func TestMapRepoDigestsToTags(t *testing.T) {
 			[]string{"v1", "latest"},
 		},
 		{
-			"foo/bar:notpushedyet",
+			// name@digest form must match the same repository as name:tag.
+			"vaijab/did@sha256:b3bedb83fb69f207d69adffb2e5690b449b658ea2c139240d20f2ef56bcb4c6f",
+			"vaijab/did@sha256:b3bedb83fb69f207d69adffb2e5690b449b658ea2c139240d20f2ef56bcb4c6f",
+			[]string{"v1", "latest"},
+		},
+		{
+			// foo/bar must not pick up tags/digests belonging to foo/bar-baz.
+			"foo/bar:v1",
+			"foo/bar@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			[]string{"v1"},
+		},
+		{
+			"notpushedyet/unknown:latest",
 			"",
 			[]string{},
 		},
 	}
 
 	for _, c := range cases {
-		m := mapRepoDigestsToTags(c.name, s)
+		named, err := reference.ParseNormalizedNamed(c.name)
+		if !assert.NoError(t, err, "failed to parse image name %q", c.name) {
+			continue
+		}
+
+		m := mapRepoDigestsToTags(named, s)
 		tags, ok := m[c.repoDigest]
 		if c.repoDigest != "" && !ok {
 			t.Errorf("failed to match repo digest given an image name %q", c.name)
@@ -59,3 +84,99 @@ func TestMapRepoDigestsToTags(t *testing.T) {
 		}
 	}
 }
+
+func TestEventHandlersRouting(t *testing.T) {
+	cases := []struct {
+		action string
+		want   func(events.Message, *imagelist.Client)
+	}{
+		{"push", handlePush},
+		{"tag", handleTag},
+		{"untag", handleUntag},
+		{"delete", handleDelete},
+	}
+
+	for _, c := range cases {
+		got, ok := eventHandlers[c.action]
+		if !ok {
+			t.Fatalf("no handler registered for action %q", c.action)
+		}
+		if reflect.ValueOf(got).Pointer() != reflect.ValueOf(c.want).Pointer() {
+			t.Errorf("eventHandlers[%q] does not point at the expected handler", c.action)
+		}
+	}
+}
+
+// TestHandleTagMissingNameAttribute guards against regressing to treating
+// a "tag" event's m.ID as a name reference: docker sets it to the
+// image's local content ID for "tag" events, so the real tag comes from
+// the "name" actor attribute and the handler must bail out without one.
+func TestHandleTagMissingNameAttribute(t *testing.T) {
+	handleTag(events.Message{ID: "sha256:deadbeef", Actor: events.Actor{ID: "sha256:deadbeef"}}, &imagelist.Client{})
+}
+
+// TestHandleUntagWithoutPriorSubmissionIsNoop guards against treating a
+// "untag" event's Actor.Attributes["name"] as a usable reference: docker
+// sets it to the image ID too, so there is nothing to reconcile unless
+// submitted already has a record for this image ID.
+func TestHandleUntagWithoutPriorSubmissionIsNoop(t *testing.T) {
+	handleUntag(events.Message{ID: "sha256:untracked-untag"}, &imagelist.Client{})
+}
+
+// TestHandleDeleteWithoutPriorSubmissionIsNoop guards against calling
+// cl.Delete with a "delete" event's m.ID directly: that's a local
+// content ID, not the repo-scoped manifest digest imagelist keys records
+// by, so delete must come from submitted's record instead.
+func TestHandleDeleteWithoutPriorSubmissionIsNoop(t *testing.T) {
+	handleDelete(events.Message{ID: "sha256:untracked-delete"}, &imagelist.Client{})
+}
+
+func TestDigestOf(t *testing.T) {
+	cases := []struct {
+		id      string
+		want    string
+		wantErr bool
+	}{
+		{"quay.io/vaijab/did@sha256:42c5ace3ac1e133a49d81086993e5817e70c67cdbf808bf8934aac78e3e416f0", "sha256:42c5ace3ac1e133a49d81086993e5817e70c67cdbf808bf8934aac78e3e416f0", false},
+		{"quay.io/vaijab/did:latest", "", true},
+		{"not a valid reference", "", true},
+	}
+
+	for _, c := range cases {
+		got, err := digestOf(c.id)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("digestOf(%q): expected an error, got none", c.id)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("digestOf(%q): unexpected error: %v", c.id, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("digestOf(%q) = %q, want %q", c.id, got, c.want)
+		}
+	}
+}
+
+func TestSubmittedTracker(t *testing.T) {
+	imageID := "sha256:tracked"
+	fooImages := []imagelist.Image{{ID: "registry.example.com/foo@sha256:aaa", Name: "registry.example.com/foo", Tags: []string{"v1"}}}
+	barImages := []imagelist.Image{{ID: "registry.example.com/bar@sha256:bbb", Name: "registry.example.com/bar", Tags: []string{"v1"}}}
+
+	assert.Empty(t, submitted.names(imageID), "names on an unknown image ID must be empty")
+
+	submitted.record(imageID, fooImages[0].Name, fooImages)
+	assert.Equal(t, []string{fooImages[0].Name}, submitted.names(imageID))
+
+	// Tagging the same image content into a second repository must add
+	// to the tracked repositories, not replace the first one.
+	submitted.record(imageID, barImages[0].Name, barImages)
+	assert.ElementsMatch(t, []string{fooImages[0].Name, barImages[0].Name}, submitted.names(imageID))
+
+	got := submitted.forget(imageID)
+	assert.ElementsMatch(t, append(append([]imagelist.Image{}, fooImages...), barImages...), got)
+	assert.Empty(t, submitted.names(imageID), "forget must remove every repository tracked for the image ID")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// readinessMaxSubmissionAge is how stale the last successful imagelist
+// submission may be before /readyz reports not-ready.
+const readinessMaxSubmissionAge = 10 * time.Minute
+
+var (
+	eventsReceivedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "events_received_total",
+		Help: "Number of docker image events received, by action.",
+	}, []string{"action"})
+
+	submissionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "submissions_total",
+		Help: "Number of imagelist submissions, by result.",
+	}, []string{"result"})
+
+	submissionRetriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "submission_retries_total",
+		Help: "Number of retries performed while submitting images to imagelist.",
+	})
+
+	submissionDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "submission_duration_seconds",
+		Help:    "Time taken to submit an image to imagelist, including retries.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	dockerReconnectsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "docker_reconnects_total",
+		Help: "Number of times the docker events connection was re-established after the first connection.",
+	})
+
+	inflightSubmissions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "inflight_submissions",
+		Help: "Number of imagelist submissions currently in flight.",
+	})
+)
+
+// health tracks the external dependency state reported by /healthz and
+// /readyz: whether the docker events connection is up, and how long ago
+// imagelist last accepted a submission.
+type health struct {
+	mu               sync.RWMutex
+	dockerConnected  bool
+	dockerErr        error
+	lastSubmissionAt time.Time
+}
+
+var agentHealth = &health{}
+
+func (h *health) setDockerConnected(connected bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dockerConnected = connected
+	h.dockerErr = err
+}
+
+func (h *health) recordSubmission(at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSubmissionAt = at
+}
+
+func (h *health) snapshot() (connected bool, dockerErr error, lastSubmissionAt time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.dockerConnected, h.dockerErr, h.lastSubmissionAt
+}
+
+// startMetricsServer serves /metrics, /healthz and /readyz on addr. It
+// blocks until the listener fails, so callers should run it in a
+// goroutine.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Printf("error: metrics server failed: %v", err)
+	}
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	connected, dockerErr, _ := agentHealth.snapshot()
+
+	body := map[string]interface{}{"dockerConnected": connected}
+	status := http.StatusOK
+	if !connected {
+		status = http.StatusServiceUnavailable
+		if dockerErr != nil {
+			body["error"] = dockerErr.Error()
+		}
+	}
+
+	writeHealthResponse(w, status, body)
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	connected, _, lastSubmissionAt := agentHealth.snapshot()
+
+	body := map[string]interface{}{"dockerConnected": connected}
+	status := http.StatusOK
+
+	if !connected {
+		status = http.StatusServiceUnavailable
+		body["error"] = "docker events connection is down"
+	}
+
+	if !lastSubmissionAt.IsZero() {
+		age := time.Since(lastSubmissionAt)
+		body["lastSubmissionAgeSeconds"] = age.Seconds()
+		if age > readinessMaxSubmissionAge {
+			status = http.StatusServiceUnavailable
+			body["error"] = "no successful imagelist submission recently"
+		}
+	}
+
+	writeHealthResponse(w, status, body)
+}
+
+func writeHealthResponse(w http.ResponseWriter, status int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
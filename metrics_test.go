@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	agentHealth.setDockerConnected(true, nil)
+	agentHealth.recordSubmission(time.Time{})
+
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 200, w.Code, "expected ready with docker connected and no submissions yet")
+
+	agentHealth.recordSubmission(time.Now().Add(-readinessMaxSubmissionAge * 2))
+	w = httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 503, w.Code, "expected not-ready when the last submission is stale")
+
+	agentHealth.setDockerConnected(false, nil)
+	w = httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 503, w.Code, "expected not-ready when docker is disconnected")
+}
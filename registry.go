@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+
+	"github.com/UKHomeOffice/imagelist-docker-events/imagelist"
+)
+
+const registryCatalogPath = "/v2/_catalog"
+
+var linkNextRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// registryReconciler periodically walks a registry's v2 catalog and
+// submits every repository's tags to imagelist. This keeps imagelist in
+// sync on hosts that never see the docker push events themselves, and
+// catches anything pushed while the agent was down.
+type registryReconciler struct {
+	registryURL     string
+	registryHost    string
+	imagelistClient *imagelist.Client
+	cursorPath      string
+	httpClient      *http.Client
+}
+
+// reconcileCursor remembers the last repository reconciled, so a restart
+// resumes the catalog walk instead of starting over.
+type reconcileCursor struct {
+	LastRepository string `json:"last_repository"`
+}
+
+func newRegistryReconciler(registryURL string, imagelistClient *imagelist.Client, cursorPath string) *registryReconciler {
+	registryURL = strings.TrimRight(registryURL, "/")
+
+	var registryHost string
+	if u, err := url.Parse(registryURL); err == nil {
+		registryHost = u.Host
+	}
+
+	return &registryReconciler{
+		registryURL:     registryURL,
+		registryHost:    registryHost,
+		imagelistClient: imagelistClient,
+		cursorPath:      cursorPath,
+		httpClient:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// run reconciles the registry's catalog against imagelist every interval,
+// until ctx is cancelled.
+func (r *registryReconciler) run(ctx context.Context, interval time.Duration) {
+	for {
+		if err := r.reconcileOnce(ctx); err != nil {
+			logger.Printf("error: registry reconciliation failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// reconcileOnce walks the registry's catalog once and submits every
+// repository to imagelist. The on-disk cursor records the last repository
+// reconciled: when a previous walk did not complete (a restart, or a
+// catalog request that failed), the walk resumes after that repository.
+// The cursor is cleared as soon as a walk completes, so the call after a
+// completed walk re-walks the whole catalog from the beginning.
+func (r *registryReconciler) reconcileOnce(ctx context.Context) error {
+	cursor := r.loadCursor()
+
+	catalogURL, err := joinURL(r.registryURL, registryCatalogPath)
+	if err != nil {
+		return fmt.Errorf("failed to build catalog url: %v", err)
+	}
+	if cursor.LastRepository != "" {
+		catalogURL += "?last=" + url.QueryEscape(cursor.LastRepository)
+	}
+
+	for catalogURL != "" {
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		next, err := r.getJSON(ctx, catalogURL, &page)
+		if err != nil {
+			return fmt.Errorf("failed to list catalog: %v", err)
+		}
+
+		for _, name := range page.Repositories {
+			if err := r.reconcileRepository(ctx, name); err != nil {
+				logger.Printf("error: failed to reconcile %q: %v", name, err)
+				continue
+			}
+
+			cursor.LastRepository = name
+			if err := r.saveCursor(cursor); err != nil {
+				logger.Printf("error: failed to persist reconcile cursor: %v", err)
+			}
+		}
+
+		catalogURL = next
+	}
+
+	if err := r.saveCursor(reconcileCursor{}); err != nil {
+		logger.Printf("error: failed to reset reconcile cursor: %v", err)
+	}
+
+	return nil
+}
+
+// qualifyRepoName prefixes name with the registry's host, so a repository
+// reconciled from the catalog gets the same canonical domain/path that
+// reference.ParseNormalizedNamed would give the same image discovered via
+// a docker push event. Without this, any non-docker.io registry produces
+// a second, unqualified imagelist record for every image already
+// submitted by the docker-events path.
+func (r *registryReconciler) qualifyRepoName(name string) (string, error) {
+	if r.registryHost == "" {
+		return "", fmt.Errorf("cannot qualify repository %q: registry host is unknown", name)
+	}
+
+	named, err := reference.ParseNormalizedNamed(r.registryHost + "/" + name)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse qualified repository %q: %v", name, err)
+	}
+
+	return named.Name(), nil
+}
+
+// reconcileRepository lists every tag of name, resolves each tag's
+// manifest digest and submits the resulting {id, name, tags} record to
+// imagelist, one PUT per distinct digest.
+func (r *registryReconciler) reconcileRepository(ctx context.Context, name string) error {
+	tagsURL, err := joinURL(r.registryURL, fmt.Sprintf("/v2/%s/tags/list", name))
+	if err != nil {
+		return err
+	}
+
+	tagsByDigest := make(map[string][]string)
+
+	for tagsURL != "" {
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		next, err := r.getJSON(ctx, tagsURL, &page)
+		if err != nil {
+			return fmt.Errorf("failed to list tags: %v", err)
+		}
+
+		for _, tag := range page.Tags {
+			digest, err := r.manifestDigest(ctx, name, tag)
+			if err != nil {
+				logger.Printf("error: failed to get digest for %s:%s: %v", name, tag, err)
+				continue
+			}
+			tagsByDigest[digest] = append(tagsByDigest[digest], tag)
+		}
+
+		tagsURL = next
+	}
+
+	qualifiedName, err := r.qualifyRepoName(name)
+	if err != nil {
+		return err
+	}
+
+	for digest, tags := range tagsByDigest {
+		img := imagelist.Image{
+			ID:   fmt.Sprintf("%s@%s", qualifiedName, digest),
+			Name: qualifiedName,
+			Tags: tags,
+		}
+		if err := r.imagelistClient.Put(img); err != nil {
+			logger.Printf("error submitting %q image: %v", img.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *registryReconciler) manifestDigest(ctx context.Context, name, tag string) (string, error) {
+	manifestURL, err := joinURL(r.registryURL, fmt.Sprintf("/v2/%s/manifests/%s", name, tag))
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := r.do(ctx, http.MethodHead, manifestURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from %s", resp.StatusCode, manifestURL)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("no Docker-Content-Digest header for %s:%s", name, tag)
+	}
+
+	return digest, nil
+}
+
+// getJSON performs an authenticated GET, decodes the JSON body into v and
+// returns the absolute URL of the next page, if the response carried a
+// Link: <...>; rel="next" header.
+func (r *registryReconciler) getJSON(ctx context.Context, u string, v interface{}) (string, error) {
+	resp, err := r.do(ctx, http.MethodGet, u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from %s", resp.StatusCode, u)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", fmt.Errorf("failed to decode response from %s: %v", u, err)
+	}
+
+	return r.nextPageURL(resp.Header.Get("Link"))
+}
+
+func (r *registryReconciler) nextPageURL(link string) (string, error) {
+	m := linkNextRegexp.FindStringSubmatch(link)
+	if len(m) != 2 {
+		return "", nil
+	}
+
+	if strings.HasPrefix(m[1], "http://") || strings.HasPrefix(m[1], "https://") {
+		return m[1], nil
+	}
+
+	return joinURL(r.registryURL, m[1])
+}
+
+// do performs a registry request, transparently obtaining and retrying
+// with a bearer token if the registry challenges the first attempt with a
+// 401 and a WWW-Authenticate: Bearer header.
+func (r *registryReconciler) do(ctx context.Context, method, u string) (*http.Response, error) {
+	resp, err := r.doOnce(ctx, method, u, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("Www-Authenticate")
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	token, err := r.bearerToken(ctx, challenge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate with registry: %v", err)
+	}
+
+	return r.doOnce(ctx, method, u, token)
+}
+
+func (r *registryReconciler) doOnce(ctx context.Context, method, u, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return r.httpClient.Do(req)
+}
+
+// bearerChallenge holds the parameters of a WWW-Authenticate: Bearer
+// challenge, as returned by a registry's 401 response.
+type bearerChallenge struct {
+	realm   string
+	service string
+	scope   string
+}
+
+var (
+	bearerSchemeRegexp = regexp.MustCompile(`^Bearer (.+)$`)
+	bearerParamRegexp  = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+func parseBearerChallenge(header string) (bearerChallenge, error) {
+	m := bearerSchemeRegexp.FindStringSubmatch(header)
+	if len(m) != 2 {
+		return bearerChallenge{}, fmt.Errorf("unsupported auth challenge %q", header)
+	}
+
+	var c bearerChallenge
+	for _, p := range bearerParamRegexp.FindAllStringSubmatch(m[1], -1) {
+		switch p[1] {
+		case "realm":
+			c.realm = p[2]
+		case "service":
+			c.service = p[2]
+		case "scope":
+			c.scope = p[2]
+		}
+	}
+
+	if c.realm == "" {
+		return c, fmt.Errorf("auth challenge %q is missing a realm", header)
+	}
+
+	return c, nil
+}
+
+func (r *registryReconciler) bearerToken(ctx context.Context, challenge string) (string, error) {
+	c, err := parseBearerChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+
+	tokenURL, err := url.Parse(c.realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid realm %q: %v", c.realm, err)
+	}
+
+	q := tokenURL.Query()
+	if c.service != "" {
+		q.Set("service", c.service)
+	}
+	if c.scope != "" {
+		q.Set("scope", c.scope)
+	}
+	tokenURL.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint %s returned status %d", tokenURL.String(), resp.StatusCode)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %v", err)
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+func (r *registryReconciler) loadCursor() reconcileCursor {
+	var cursor reconcileCursor
+	if r.cursorPath == "" {
+		return cursor
+	}
+
+	data, err := ioutil.ReadFile(r.cursorPath)
+	if err != nil {
+		return cursor
+	}
+
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		logger.Printf("error: failed to parse reconcile cursor %q: %v", r.cursorPath, err)
+	}
+
+	return cursor
+}
+
+func (r *registryReconciler) saveCursor(cursor reconcileCursor) error {
+	if r.cursorPath == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(r.cursorPath, data, 0644)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UKHomeOffice/imagelist-docker-events/imagelist"
+)
+
+func TestParseBearerChallenge(t *testing.T) {
+	cases := []struct {
+		header  string
+		want    bearerChallenge
+		wantErr bool
+	}{
+		{
+			`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo/bar:pull"`,
+			bearerChallenge{realm: "https://auth.example.com/token", service: "registry.example.com", scope: "repository:foo/bar:pull"},
+			false,
+		},
+		{
+			`Bearer realm="https://auth.example.com/token"`,
+			bearerChallenge{realm: "https://auth.example.com/token"},
+			false,
+		},
+		{
+			`Basic realm="registry"`,
+			bearerChallenge{},
+			true,
+		},
+		{
+			`Bearer service="registry.example.com"`,
+			bearerChallenge{},
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		got, err := parseBearerChallenge(c.header)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseBearerChallenge(%q): expected an error, got none", c.header)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseBearerChallenge(%q): unexpected error: %v", c.header, err)
+			continue
+		}
+
+		if got != c.want {
+			t.Errorf("parseBearerChallenge(%q) = %+v, want %+v", c.header, got, c.want)
+		}
+	}
+}
+
+func TestRegistryReconcilerQualifyRepoName(t *testing.T) {
+	cases := []struct {
+		registryURL string
+		name        string
+		want        string
+	}{
+		{"https://registry.example.com", "foo/bar", "registry.example.com/foo/bar"},
+		{"https://registry.example.com:5000", "foo/bar", "registry.example.com:5000/foo/bar"},
+		{"https://registry.example.com", "bar", "registry.example.com/bar"},
+	}
+
+	for _, c := range cases {
+		r := newRegistryReconciler(c.registryURL, &imagelist.Client{}, "")
+
+		got, err := r.qualifyRepoName(c.name)
+		if err != nil {
+			t.Errorf("qualifyRepoName(%q) against %q: unexpected error: %v", c.name, c.registryURL, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("qualifyRepoName(%q) against %q = %q, want %q", c.name, c.registryURL, got, c.want)
+		}
+	}
+}
+
+// fakeRegistry serves a two-repository catalog, one "latest" tag per
+// repository and a fixed manifest digest for that tag, recording the
+// ?last= value used on every catalog request.
+func fakeRegistry(t *testing.T, catalogRequests *[]string) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/_catalog", func(w http.ResponseWriter, r *http.Request) {
+		*catalogRequests = append(*catalogRequests, r.URL.Query().Get("last"))
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": {"foo/bar", "foo/baz"}})
+	})
+	mux.HandleFunc("/v2/foo/bar/tags/list", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]string{"tags": {"latest"}})
+	})
+	mux.HandleFunc("/v2/foo/baz/tags/list", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]string{"tags": {"latest"}})
+	})
+	mux.HandleFunc("/v2/foo/bar/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", "sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	})
+	mux.HandleFunc("/v2/foo/baz/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", "sha256:2222222222222222222222222222222222222222222222222222222222222222")
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestReconcileOnceResetsCursorOnCompletion(t *testing.T) {
+	var catalogRequests []string
+	registrySrv := fakeRegistry(t, &catalogRequests)
+	defer registrySrv.Close()
+
+	var putCount int
+	imagelistSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		putCount++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer imagelistSrv.Close()
+
+	cl := &imagelist.Client{URL: imagelistSrv.URL, HTTPClient: imagelistSrv.Client()}
+	r := newRegistryReconciler(registrySrv.URL, cl, filepath.Join(t.TempDir(), "cursor.json"))
+
+	if err := r.reconcileOnce(context.Background()); err != nil {
+		t.Fatalf("first reconcileOnce: unexpected error: %v", err)
+	}
+	if err := r.reconcileOnce(context.Background()); err != nil {
+		t.Fatalf("second reconcileOnce: unexpected error: %v", err)
+	}
+
+	assert.Equal(t, []string{"", ""}, catalogRequests, "every walk must start the catalog from the beginning, not from a stale cursor")
+	assert.Equal(t, 4, putCount, "each of the 2 completed walks must resubmit both repositories")
+}
+
+func TestRegistryReconcilerNextPageURL(t *testing.T) {
+	r := newRegistryReconciler("https://registry.example.com", &imagelist.Client{}, "")
+
+	cases := []struct {
+		link string
+		want string
+	}{
+		{``, ""},
+		{`</v2/_catalog?n=100&last=bar>; rel="next"`, "https://registry.example.com/v2/_catalog?n=100&last=bar"},
+		{`<https://other.example.com/v2/_catalog?last=bar>; rel="next"`, "https://other.example.com/v2/_catalog?last=bar"},
+	}
+
+	for _, c := range cases {
+		got, err := r.nextPageURL(c.link)
+		if err != nil {
+			t.Errorf("nextPageURL(%q): unexpected error: %v", c.link, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("nextPageURL(%q) = %q, want %q", c.link, got, c.want)
+		}
+	}
+}